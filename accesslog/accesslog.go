@@ -0,0 +1,109 @@
+// Package accesslog implements the structured access logger: a pluggable
+// text/JSON record format written through an optionally rotating writer.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Format selects how a Record is rendered.
+type Format string
+
+const (
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+)
+
+// Record is a single access log entry. In FormatJSON it's written under the
+// snake_case keys declared on jsonRecord ("ts", "client", "xff_chain", ...),
+// so downstream log ingestion doesn't need regex parsing.
+type Record struct {
+	Timestamp      time.Time
+	Client         string
+	XFFChain       string
+	Method         string
+	Host           string
+	Path           string
+	Query          string
+	Status         int
+	RouteID        string
+	SourceURL      string
+	DestinationURL string
+	DurationMS     int64
+	UserAgent      string
+}
+
+// jsonRecord is Record's wire representation for FormatJSON.
+type jsonRecord struct {
+	Timestamp      string `json:"ts"`
+	Client         string `json:"client"`
+	XFFChain       string `json:"xff_chain"`
+	Method         string `json:"method"`
+	Host           string `json:"host"`
+	Path           string `json:"path"`
+	Query          string `json:"query"`
+	Status         int    `json:"status"`
+	RouteID        string `json:"route_id"`
+	SourceURL      string `json:"source_url"`
+	DestinationURL string `json:"destination_url"`
+	DurationMS     int64  `json:"duration_ms"`
+	UserAgent      string `json:"user_agent"`
+}
+
+// Logger writes Records to writer in format, one record per line.
+type Logger struct {
+	format Format
+	writer io.Writer
+}
+
+// NewLogger returns a Logger writing in format to writer.
+func NewLogger(format Format, writer io.Writer) (*Logger, error) {
+	switch format {
+	case FormatText, FormatJSON:
+	default:
+		return nil, fmt.Errorf("Invalid access log format %q (must be \"text\" or \"json\")", format)
+	}
+	return &Logger{format: format, writer: writer}, nil
+}
+
+// Log writes record in the logger's configured format.
+func (logger *Logger) Log(record Record) {
+	switch logger.format {
+	case FormatJSON:
+		logger.logJSON(record)
+	default:
+		logger.logText(record)
+	}
+}
+
+func (logger *Logger) logText(record Record) {
+	fmt.Fprintf(logger.writer, "Request: client=\"%v\" status=\"%v\" route=\"%v\" source=\"%v\" destination=\"%v\" duration_ms=\"%v\"\n",
+		record.Client, record.Status, record.RouteID, record.SourceURL, record.DestinationURL, record.DurationMS)
+}
+
+func (logger *Logger) logJSON(record Record) {
+	wire := jsonRecord{
+		Timestamp:      record.Timestamp.UTC().Format(time.RFC3339Nano),
+		Client:         record.Client,
+		XFFChain:       record.XFFChain,
+		Method:         record.Method,
+		Host:           record.Host,
+		Path:           record.Path,
+		Query:          record.Query,
+		Status:         record.Status,
+		RouteID:        record.RouteID,
+		SourceURL:      record.SourceURL,
+		DestinationURL: record.DestinationURL,
+		DurationMS:     record.DurationMS,
+		UserAgent:      record.UserAgent,
+	}
+	data, err := json.Marshal(wire)
+	if err != nil {
+		fmt.Fprintf(logger.writer, "{\"error\": \"failed to marshal access log record: %v\"}\n", err)
+		return
+	}
+	logger.writer.Write(append(data, '\n'))
+}
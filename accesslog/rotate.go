@@ -0,0 +1,118 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// RotatingWriter is an io.Writer over a file at path that rotates (renames
+// the current file aside and reopens a fresh one at path) when it exceeds
+// maxSizeBytes and/or when the day changes, depending on which is enabled.
+// The most recently rotated-to file is kept symlinked as "<path>.current".
+type RotatingWriter struct {
+	path         string
+	maxSizeBytes int64
+	daily        bool
+
+	mutex     sync.Mutex
+	file      *os.File
+	size      int64
+	openedDay string
+}
+
+// NewRotatingWriter opens (creating if needed) the log file at path.
+// maxSizeBytes <= 0 disables size-based rotation; daily enables rotating at
+// the first write after local midnight.
+func NewRotatingWriter(path string, maxSizeBytes int64, daily bool) (*RotatingWriter, error) {
+	writer := &RotatingWriter{
+		path:         path,
+		maxSizeBytes: maxSizeBytes,
+		daily:        daily,
+	}
+	if err := writer.open(); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// Write implements io.Writer, rotating first if p would push the file past
+// maxSizeBytes or the day has changed since the file was opened.
+func (writer *RotatingWriter) Write(p []byte) (int, error) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	if writer.shouldRotateLocked(len(p)) {
+		if err := writer.rotateLocked(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := writer.file.Write(p)
+	writer.size += int64(n)
+	return n, err
+}
+
+func (writer *RotatingWriter) shouldRotateLocked(nextWriteLen int) bool {
+	if writer.maxSizeBytes > 0 && writer.size+int64(nextWriteLen) > writer.maxSizeBytes {
+		return true
+	}
+	if writer.daily && writer.openedDay != currentDay() {
+		return true
+	}
+	return false
+}
+
+// open opens (creating if needed) the log file at writer.path, recording its
+// current size and day so later writes know when to rotate.
+func (writer *RotatingWriter) open() error {
+	file, err := os.OpenFile(writer.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to open access log file %v: \n%v", writer.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Failed to stat access log file %v: \n%v", writer.path, err)
+	}
+
+	writer.file = file
+	writer.size = info.Size()
+	writer.openedDay = currentDay()
+	return writer.relinkCurrent()
+}
+
+// rotateLocked renames the current log file aside with a timestamp suffix,
+// reopens a fresh file at writer.path and repoints the "current" symlink at
+// it. Callers must hold writer.mutex.
+func (writer *RotatingWriter) rotateLocked() error {
+	if err := writer.file.Close(); err != nil {
+		return fmt.Errorf("Failed to close access log file before rotating: \n%v", err)
+	}
+
+	rotatedPath := fmt.Sprintf("%v.%v", writer.path, time.Now().Format("20060102-150405"))
+	if err := os.Rename(writer.path, rotatedPath); err != nil {
+		return fmt.Errorf("Failed to rotate access log file to %v: \n%v", rotatedPath, err)
+	}
+
+	return writer.open()
+}
+
+// relinkCurrent points "<path>.current" at the active log file, replacing
+// any existing symlink.
+func (writer *RotatingWriter) relinkCurrent() error {
+	currentPath := writer.path + ".current"
+	os.Remove(currentPath)
+	// The link sits beside the log file, and a relative symlink target is
+	// resolved from the link's own directory, so link to the base name only.
+	if err := os.Symlink(filepath.Base(writer.path), currentPath); err != nil {
+		return fmt.Errorf("Failed to symlink %v to %v: \n%v", currentPath, writer.path, err)
+	}
+	return nil
+}
+
+func currentDay() string {
+	return time.Now().Format("2006-01-02")
+}
@@ -1,32 +1,75 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/HON95/URL-Manager/accesslog"
+	"github.com/HON95/URL-Manager/store"
+	"github.com/HON95/URL-Manager/template"
 )
 
 const defaultEndpoint = ":8080"
 const defaultRouteFilePath = "routes.json"
 const defaultRedirectStatus = 302
+const defaultRouteMode = "redirect"
+const defaultLogFormat = "text"
+const adminTokenEnvVar = "URL_MANAGER_ADMIN_TOKEN"
 
 var enableDebug = false
 var enableRequestLogging = false
 var endpoint = defaultEndpoint
 var routeFilePath = defaultRouteFilePath
+var routeStoreDSN = ""
 var metricsEndpoint = ""
+var adminEndpoint = ""
+var adminToken = ""
+var adminPersistRoutes = false
+var logFormat = defaultLogFormat
+var logFilePath = ""
+var logRotateSizeBytes int64 = 0
+var logRotateDaily = false
 var compiledRouteIDPattern = regexp.MustCompile(`^[0-9a-zA-Z-_]+$`)
 
+// accessLogger is the active access logger, built from -log-format/-log-file/
+// -log-rotate-* by buildAccessLogger and used by logRequest when
+// enableRequestLogging is set.
+var accessLogger *accesslog.Logger
+
+// routeStore is the active route storage backend, selected by -route-store
+// (defaulting to the JSON file at routeFilePath).
+var routeStore store.RouteStore
+
+const sqliteRouteStorePrefix = "sqlite://"
+
+// routesMutex guards routes, compositeRoutes and urlRoutes. Readers
+// (findBestRoute and its callers) take an RLock, admin API mutations take a
+// full Lock while they rebuild the tree.
+var routesMutex sync.RWMutex
+
+// proxyCacheMutex guards proxyCache, the per-route/per-destination-host
+// *httputil.ReverseProxy cache used by proxy-mode routes.
+var proxyCacheMutex sync.Mutex
+var proxyCache = make(map[string]*httputil.ReverseProxy)
+
 var metricsInfoGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
 	Name: "url_manager_info",
 	Help: "Metadata about the exporter.",
@@ -47,26 +90,43 @@ var metricsRouteMalformedDestinationCounter = promauto.NewCounterVec(prometheus.
 	Name: "url_manager_route_malformed_destination_total",
 	Help: "The number of times a route has resulted in an invalid destination URL.",
 }, []string{"route"})
+var metricsAdminOperationsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "url_manager_admin_operations_total",
+	Help: "The number of admin API operations performed, by operation and result.",
+}, []string{"operation", "result"})
+var metricsProxyRequestsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "url_manager_proxy_requests_total",
+	Help: "The total number of requests handled by a proxy-mode route.",
+}, []string{"route", "code"})
+var metricsProxyUpstreamErrorsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "url_manager_proxy_upstream_errors_total",
+	Help: "The number of times a proxy-mode route failed to reach its upstream.",
+}, []string{"route"})
 
-// Route is a matching for an incoming URL and an associated redirect.
+// Route is a matching for an incoming URL and an associated redirect (or, in
+// "proxy" mode, an upstream to forward the request to).
 type Route struct {
-	ID                   string         `json:"id"`
-	Disabled             bool           `json:"disabled"`
-	SourceURL            string         `json:"source_url"`
-	SourceScheme         string         `json:"source_scheme"`
-	SourceHost           string         `json:"source_host"`
-	SourcePort           string         `json:"source_port"`
-	SourcePath           string         `json:"source_path"`
-	SourceQuery          string         `json:"source_query"`
-	DestinationURL       string         `json:"destination_url"`
-	RedirectStatus       int            `json:"redirect_status"`
-	Priority             int            `json:"priority"`
-	CompiledSourceURL    *regexp.Regexp `json:"-"`
-	CompiledSourceScheme *regexp.Regexp `json:"-"`
-	CompiledSourceHost   *regexp.Regexp `json:"-"`
-	CompiledSourcePort   *regexp.Regexp `json:"-"`
-	CompiledSourcePath   *regexp.Regexp `json:"-"`
-	CompiledSourceQuery  *regexp.Regexp `json:"-"`
+	ID                     string             `json:"id"`
+	Disabled               bool               `json:"disabled"`
+	SourceURL              string             `json:"source_url"`
+	SourceScheme           string             `json:"source_scheme"`
+	SourceHost             string             `json:"source_host"`
+	SourcePort             string             `json:"source_port"`
+	SourcePath             string             `json:"source_path"`
+	SourceQuery            string             `json:"source_query"`
+	SourceTemplate         string             `json:"source_template"`
+	DestinationURL         string             `json:"destination_url"`
+	Mode                   string             `json:"mode"`
+	RedirectStatus         int                `json:"redirect_status"`
+	ProxyTimeout           int                `json:"proxy_timeout"`
+	Priority               int                `json:"priority"`
+	CompiledSourceURL      *regexp.Regexp     `json:"-"`
+	CompiledSourceScheme   *regexp.Regexp     `json:"-"`
+	CompiledSourceHost     *regexp.Regexp     `json:"-"`
+	CompiledSourcePort     *regexp.Regexp     `json:"-"`
+	CompiledSourcePath     *regexp.Regexp     `json:"-"`
+	CompiledSourceQuery    *regexp.Regexp     `json:"-"`
+	CompiledSourceTemplate *template.Template `json:"-"`
 }
 
 // List of all routes
@@ -108,16 +168,80 @@ type urlRouteGroup struct {
 	routes      []*Route
 }
 
+// List of source template routes (group on same raw template string)
+var templateRoutes map[string]*templateRouteGroup
+
+type templateRouteGroup struct {
+	compiledTemplate *template.Template
+	routes           []*Route
+}
+
+// previousCompositeRoutes, previousURLRoutes and previousTemplateRoutes hold
+// the tree being replaced by an in-progress rebuildRouteTreesLocked, so
+// loadRoute can reuse an already-compiled pattern for a raw source string
+// that's unchanged from the previous generation instead of recompiling it.
+// All three are nil outside of a rebuild.
+var previousCompositeRoutes map[string]*schemeRouteGroup
+var previousURLRoutes map[string]*urlRouteGroup
+var previousTemplateRoutes map[string]*templateRouteGroup
+
+func previousSchemeGroup(scheme string) *schemeRouteGroup {
+	return previousCompositeRoutes[scheme]
+}
+
+func previousHostGroup(scheme string, host string) *hostRouteGroup {
+	if schemeGroup := previousSchemeGroup(scheme); schemeGroup != nil {
+		return schemeGroup.hostRoutes[host]
+	}
+	return nil
+}
+
+func previousPortGroup(scheme string, host string, port string) *portRouteGroup {
+	if hostGroup := previousHostGroup(scheme, host); hostGroup != nil {
+		return hostGroup.portRoutes[port]
+	}
+	return nil
+}
+
+func previousPathGroup(scheme string, host string, port string, path string) *pathRouteGroup {
+	if portGroup := previousPortGroup(scheme, host, port); portGroup != nil {
+		return portGroup.pathRoutes[path]
+	}
+	return nil
+}
+
+func previousQueryGroup(scheme string, host string, port string, path string, query string) *queryRouteGroup {
+	if pathGroup := previousPathGroup(scheme, host, port, path); pathGroup != nil {
+		return pathGroup.queryRoutes[query]
+	}
+	return nil
+}
+
 func main() {
 	fmt.Printf("%v version %v by %v.\n\n", appName, appVersion, appAuthor)
 
 	// Init global data structures
 	compositeRoutes = make(map[string]*schemeRouteGroup)
 	urlRoutes = make(map[string]*urlRouteGroup)
+	templateRoutes = make(map[string]*templateRouteGroup)
 
 	parseCliArgs()
 
-	if err := readRouteFile(); err != nil {
+	newRouteStore, err := buildRouteStore()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	routeStore = newRouteStore
+
+	newAccessLogger, err := buildAccessLogger()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return
+	}
+	accessLogger = newAccessLogger
+
+	if err := loadRoutes(); err != nil {
 		fmt.Fprintf(os.Stderr, "%v\n", err)
 		return
 	}
@@ -128,36 +252,82 @@ func main() {
 	}
 }
 
+// buildRouteStore selects the route storage backend named by -route-store
+// ("sqlite://path.db"), defaulting to the JSON file at routeFilePath.
+func buildRouteStore() (store.RouteStore, error) {
+	if strings.HasPrefix(routeStoreDSN, sqliteRouteStorePrefix) {
+		path := strings.TrimPrefix(routeStoreDSN, sqliteRouteStorePrefix)
+		sqliteStore, err := store.NewSQLiteStore(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open SQLite route store: \n%v", err)
+		}
+		return sqliteStore, nil
+	}
+	if routeStoreDSN != "" {
+		return nil, fmt.Errorf("Unrecognized -route-store value %q (expected \"sqlite://path.db\")", routeStoreDSN)
+	}
+	return store.NewJSONFileStore(routeFilePath), nil
+}
+
+// buildAccessLogger builds the access logger named by -log-format, writing
+// to -log-file (falling back to stdout) through a size/date rotating writer
+// if -log-rotate-size and/or -log-rotate-daily are set.
+func buildAccessLogger() (*accesslog.Logger, error) {
+	var logWriter io.Writer = os.Stdout
+	if logFilePath != "" {
+		if logRotateSizeBytes > 0 || logRotateDaily {
+			rotatingWriter, err := accesslog.NewRotatingWriter(logFilePath, logRotateSizeBytes, logRotateDaily)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to open access log file: \n%v", err)
+			}
+			logWriter = rotatingWriter
+		} else {
+			file, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to open access log file %v: \n%v", logFilePath, err)
+			}
+			logWriter = file
+		}
+	}
+
+	logger, err := accesslog.NewLogger(accesslog.Format(logFormat), logWriter)
+	if err != nil {
+		return nil, err
+	}
+	return logger, nil
+}
+
 func parseCliArgs() {
 	flag.BoolVar(&enableDebug, "debug", false, "Show debug messages.")
 	flag.BoolVar(&enableRequestLogging, "log", false, "Log requests.")
 	flag.StringVar(&endpoint, "endpoint", defaultEndpoint, "The address-port endpoint to bind to.")
-	flag.StringVar(&routeFilePath, "route-file", defaultRouteFilePath, "The path to the routes JSON config file.")
+	flag.StringVar(&routeFilePath, "route-file", defaultRouteFilePath, "The path to the routes JSON config file. Ignored if -route-store is set.")
+	flag.StringVar(&routeStoreDSN, "route-store", "", "Route storage backend, e.g. \"sqlite://path.db\". Defaults to the JSON file at -route-file.")
 	flag.StringVar(&metricsEndpoint, "metrics-endpoint", "", "Metrics address-port endpoint. Disabled if not set.")
+	flag.StringVar(&adminEndpoint, "admin-endpoint", "", "Admin API address-port endpoint. Disabled if not set.")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token required to use the admin API. Can also be set via the "+adminTokenEnvVar+" environment variable.")
+	flag.BoolVar(&adminPersistRoutes, "admin-persist-routes", false, "Persist admin API route changes back to the route store (the route file or the -route-store database).")
+	flag.StringVar(&logFormat, "log-format", defaultLogFormat, "Access log record format, \"text\" or \"json\".")
+	flag.StringVar(&logFilePath, "log-file", "", "Access log file path. Defaults to stdout if not set.")
+	flag.Int64Var(&logRotateSizeBytes, "log-rotate-size", 0, "Rotate the access log file once it exceeds this many bytes. Disabled if 0. Ignored if -log-file isn't set.")
+	flag.BoolVar(&logRotateDaily, "log-rotate-daily", false, "Rotate the access log file daily. Ignored if -log-file isn't set.")
 
 	// Exits on error
 	flag.Parse()
-}
-
-func readRouteFile() error {
-	// Open file
-	file, openErr := os.Open(routeFilePath)
-	if openErr != nil {
-		return fmt.Errorf("Failed to open route file (missing file?): \n%v", openErr)
-	}
-	defer file.Close()
 
-	// Read file
-	data, readErr := io.ReadAll(file)
-	if readErr != nil {
-		return fmt.Errorf("Failed to read route file (I/O error?): \n%v", readErr)
+	if adminToken == "" {
+		adminToken = os.Getenv(adminTokenEnvVar)
 	}
+}
 
-	// Parse routes from file
-	parseErr := json.Unmarshal(data, &routes)
-	if parseErr != nil {
-		return fmt.Errorf("Failed to parse routes from file (malformed JSON file?): \n%v", parseErr)
+// loadRoutes loads the route set from routeStore and compiles it into
+// routes/compositeRoutes/urlRoutes/templateRoutes.
+func loadRoutes() error {
+	loadedRoutes, err := routeStore.Load()
+	if err != nil {
+		return err
 	}
+	routes = fromStoreRoutes(loadedRoutes)
 
 	// Load routes by compiling regexes and inserting into data structures
 	for i, route := range routes {
@@ -180,6 +350,8 @@ func readRouteFile() error {
 			fmt.Printf("  Name:            %v\n", route.ID)
 			if route.SourceURL != "" {
 				fmt.Printf("  Source URL:      %v\n", route.SourceURL)
+			} else if route.SourceTemplate != "" {
+				fmt.Printf("  Source template: %v\n", route.SourceTemplate)
 			} else {
 				fmt.Printf("  Source scheme:   %v\n", route.SourceScheme)
 				fmt.Printf("  Source host:     %v\n", route.SourceHost)
@@ -188,6 +360,7 @@ func readRouteFile() error {
 				fmt.Printf("  Source query:    %v\n", route.SourceQuery)
 			}
 			fmt.Printf("  Destination URL: %v\n", route.DestinationURL)
+			fmt.Printf("  Mode:            %v\n", route.Mode)
 			fmt.Printf("  Redirect status: %v\n", route.RedirectStatus)
 			fmt.Printf("  Priority:        %v\n", route.Priority)
 		}
@@ -208,6 +381,13 @@ func loadRoute(route *Route) error {
 		return fmt.Errorf("Missing destination URL")
 	}
 
+	// Mode
+	if route.Mode == "" {
+		route.Mode = defaultRouteMode
+	} else if route.Mode != "redirect" && route.Mode != "proxy" {
+		return fmt.Errorf("Invalid route mode (must be \"redirect\" or \"proxy\")")
+	}
+
 	// Redirect status
 	status := &route.RedirectStatus
 	if *status == 0 {
@@ -216,14 +396,43 @@ func loadRoute(route *Route) error {
 		return fmt.Errorf("Invalid redirect status value")
 	}
 
-	// Source URL or composite
+	// Source URL, composite or template
 	hasSourceURL := route.SourceURL != ""
 	hasSourceComposite := route.SourceScheme != "" || route.SourceHost != "" || route.SourcePort != "" || route.SourcePath != "" || route.SourceQuery != ""
-	if !hasSourceURL && !hasSourceComposite {
-		return fmt.Errorf("Missing source URL or composite")
+	hasSourceTemplate := route.SourceTemplate != ""
+	sourceKindCount := 0
+	for _, has := range []bool{hasSourceURL, hasSourceComposite, hasSourceTemplate} {
+		if has {
+			sourceKindCount++
+		}
+	}
+	if sourceKindCount == 0 {
+		return fmt.Errorf("Missing source URL, composite or template")
+	}
+	if sourceKindCount > 1 {
+		return fmt.Errorf("Route can't combine a source URL, composite fields and/or a source template")
 	}
-	if hasSourceURL && hasSourceComposite {
-		return fmt.Errorf("Route can't contain both a source URL and any of the source composite fields")
+
+	if hasSourceTemplate {
+		var templateGroup *templateRouteGroup
+		if group, ok := templateRoutes[route.SourceTemplate]; ok {
+			templateGroup = group
+		} else {
+			templateGroup = &templateRouteGroup{routes: make([]*Route, 0)}
+			if previous, ok := previousTemplateRoutes[route.SourceTemplate]; ok {
+				templateGroup.compiledTemplate = previous.compiledTemplate
+			} else {
+				result, err := template.Compile(route.SourceTemplate)
+				if err != nil {
+					return fmt.Errorf("Route source template won't compile.\n%v", err)
+				}
+				templateGroup.compiledTemplate = result
+			}
+			templateRoutes[route.SourceTemplate] = templateGroup
+		}
+		route.CompiledSourceTemplate = templateGroup.compiledTemplate
+		templateGroup.routes = append(templateGroup.routes, route)
+		return nil
 	}
 
 	if hasSourceURL {
@@ -231,13 +440,14 @@ func loadRoute(route *Route) error {
 		if group, ok := urlRoutes[route.SourceURL]; ok {
 			urlGroup = group
 		} else {
-			urlGroup = &urlRouteGroup{}
-			if result, err := regexp.Compile(route.SourceURL); err == nil {
+			urlGroup = &urlRouteGroup{routes: make([]*Route, 0)}
+			if previous, ok := previousURLRoutes[route.SourceURL]; ok {
+				urlGroup.compiledURL = previous.compiledURL
+			} else if result, err := regexp.Compile(route.SourceURL); err == nil {
 				urlGroup.compiledURL = result
 			} else {
 				return fmt.Errorf("Route source URL regexp won't compile.\n%v", err)
 			}
-			urlGroup.routes = make([]*Route, 0)
 			urlRoutes[route.SourceURL] = urlGroup
 		}
 		route.CompiledSourceURL = urlGroup.compiledURL
@@ -248,13 +458,14 @@ func loadRoute(route *Route) error {
 		if group, ok := compositeRoutes[route.SourceScheme]; ok {
 			schemeGroup = group
 		} else {
-			schemeGroup = &schemeRouteGroup{}
-			if result, err := regexp.Compile(route.SourceScheme); err == nil {
+			schemeGroup = &schemeRouteGroup{hostRoutes: make(map[string]*hostRouteGroup)}
+			if previous := previousSchemeGroup(route.SourceScheme); previous != nil {
+				schemeGroup.compiledScheme = previous.compiledScheme
+			} else if result, err := regexp.Compile(route.SourceScheme); err == nil {
 				schemeGroup.compiledScheme = result
 			} else {
 				return fmt.Errorf("Route source scheme regexp won't compile.\n%v", err)
 			}
-			schemeGroup.hostRoutes = make(map[string]*hostRouteGroup)
 			compositeRoutes[route.SourceScheme] = schemeGroup
 		}
 		route.CompiledSourceScheme = schemeGroup.compiledScheme
@@ -264,13 +475,14 @@ func loadRoute(route *Route) error {
 		if group, ok := schemeGroup.hostRoutes[route.SourceHost]; ok {
 			hostGroup = group
 		} else {
-			hostGroup = &hostRouteGroup{}
-			if result, err := regexp.Compile(route.SourceHost); err == nil {
+			hostGroup = &hostRouteGroup{portRoutes: make(map[string]*portRouteGroup)}
+			if previous := previousHostGroup(route.SourceScheme, route.SourceHost); previous != nil {
+				hostGroup.compiledHost = previous.compiledHost
+			} else if result, err := regexp.Compile(route.SourceHost); err == nil {
 				hostGroup.compiledHost = result
 			} else {
 				return fmt.Errorf("Route source host regexp won't compile.\n%v", err)
 			}
-			hostGroup.portRoutes = make(map[string]*portRouteGroup)
 			schemeGroup.hostRoutes[route.SourceHost] = hostGroup
 		}
 		route.CompiledSourceHost = hostGroup.compiledHost
@@ -280,13 +492,14 @@ func loadRoute(route *Route) error {
 		if group, ok := hostGroup.portRoutes[route.SourcePort]; ok {
 			portGroup = group
 		} else {
-			portGroup = &portRouteGroup{}
-			if result, err := regexp.Compile(route.SourcePort); err == nil {
+			portGroup = &portRouteGroup{pathRoutes: make(map[string]*pathRouteGroup)}
+			if previous := previousPortGroup(route.SourceScheme, route.SourceHost, route.SourcePort); previous != nil {
+				portGroup.compiledPort = previous.compiledPort
+			} else if result, err := regexp.Compile(route.SourcePort); err == nil {
 				portGroup.compiledPort = result
 			} else {
 				return fmt.Errorf("Route source port regexp won't compile.\n%v", err)
 			}
-			portGroup.pathRoutes = make(map[string]*pathRouteGroup)
 			hostGroup.portRoutes[route.SourcePort] = portGroup
 		}
 		route.CompiledSourcePort = portGroup.compiledPort
@@ -296,13 +509,14 @@ func loadRoute(route *Route) error {
 		if group, ok := portGroup.pathRoutes[route.SourcePath]; ok {
 			pathGroup = group
 		} else {
-			pathGroup = &pathRouteGroup{}
-			if result, err := regexp.Compile(route.SourcePath); err == nil {
+			pathGroup = &pathRouteGroup{queryRoutes: make(map[string]*queryRouteGroup)}
+			if previous := previousPathGroup(route.SourceScheme, route.SourceHost, route.SourcePort, route.SourcePath); previous != nil {
+				pathGroup.compiledPath = previous.compiledPath
+			} else if result, err := regexp.Compile(route.SourcePath); err == nil {
 				pathGroup.compiledPath = result
 			} else {
 				return fmt.Errorf("Route source path regexp won't compile.\n%v", err)
 			}
-			pathGroup.queryRoutes = make(map[string]*queryRouteGroup)
 			portGroup.pathRoutes[route.SourcePath] = pathGroup
 		}
 		route.CompiledSourcePath = pathGroup.compiledPath
@@ -312,13 +526,14 @@ func loadRoute(route *Route) error {
 		if group, ok := pathGroup.queryRoutes[route.SourceQuery]; ok {
 			queryGroup = group
 		} else {
-			queryGroup = &queryRouteGroup{}
-			if result, err := regexp.Compile(route.SourceQuery); err == nil {
+			queryGroup = &queryRouteGroup{routes: make([]*Route, 0)}
+			if previous := previousQueryGroup(route.SourceScheme, route.SourceHost, route.SourcePort, route.SourcePath, route.SourceQuery); previous != nil {
+				queryGroup.compiledQuery = previous.compiledQuery
+			} else if result, err := regexp.Compile(route.SourceQuery); err == nil {
 				queryGroup.compiledQuery = result
 			} else {
 				return fmt.Errorf("Route source query regexp won't compile.\n%v", err)
 			}
-			queryGroup.routes = make([]*Route, 0)
 			pathGroup.queryRoutes[route.SourceQuery] = queryGroup
 		}
 		route.CompiledSourceQuery = queryGroup.compiledQuery
@@ -332,6 +547,9 @@ func loadRoute(route *Route) error {
 func runServers() error {
 	metricsInfoGauge.With(prometheus.Labels{"version": appVersion}).Set(1)
 
+	// Route store change watcher (async routine)
+	go watchRouteStore()
+
 	// Metrics server (async routine)
 	if len(metricsEndpoint) > 0 {
 		var metricsServeMux http.ServeMux
@@ -343,6 +561,19 @@ func runServers() error {
 		}()
 	}
 
+	// Admin server (async routine)
+	if len(adminEndpoint) > 0 {
+		var adminServeMux http.ServeMux
+		adminServeMux.HandleFunc("/routes", handleAdminRoutesCollection)
+		adminServeMux.HandleFunc("/routes/", handleAdminRoutesItem)
+		adminServeMux.HandleFunc("/reload", handleAdminReload)
+		go func() {
+			if err := http.ListenAndServe(adminEndpoint, &adminServeMux); err != nil {
+				fmt.Fprintf(os.Stderr, "Error while running admin HTTP server: %v", err)
+			}
+		}()
+	}
+
 	// Main server (blocking)
 	var mainServeMux http.ServeMux
 	mainServeMux.HandleFunc("/", handleMainRequest)
@@ -354,13 +585,10 @@ func runServers() error {
 }
 
 func handleMainRequest(response http.ResponseWriter, request *http.Request) {
+	requestStart := time.Now()
 	metricsTotalCounter.Inc()
 
-	// Get local or forwarded proto, domain and from-addr
-	realFrom := request.RemoteAddr
-	if forwardedFors := request.Header["X-Forwarded-For"]; len(forwardedFors) > 0 {
-		realFrom = forwardedFors[0]
-	}
+	// Get local or forwarded proto and domain
 	realProto := "http"
 	if forwardedProtos := request.Header["X-Forwarded-Proto"]; len(forwardedProtos) > 0 {
 		realProto = forwardedProtos[0]
@@ -373,44 +601,35 @@ func handleMainRequest(response http.ResponseWriter, request *http.Request) {
 	// Build source URL
 	sourceURL := fmt.Sprintf("%v://%v%v", realProto, realHost, request.URL)
 
-	// Find matching route
+	// Find matching route and collect its named captures under a single read
+	// lock, so a concurrent admin API mutation can't swap the route's
+	// compiled patterns out from under us mid-match
+	routesMutex.RLock()
 	route := findBestRoute(&sourceURL)
+	var varMatches map[string]string
+	if route != nil {
+		scheme, host, port, path, query := splitSourceURL(sourceURL)
+		varMatches = collectVarMatches(route, sourceURL, scheme, host, port, path, query)
+	}
+	routesMutex.RUnlock()
+
 	if route == nil {
 		http.Error(response, "404 Not found.\n", http.StatusNotFound)
 		metricsNotFoundCounter.Inc()
-		logRequest(realFrom, 404, "", sourceURL, "")
+		logRequest(request, 404, "", sourceURL, "", time.Since(requestStart))
 		return
 	}
 	metricsRouteChosenCounter.With(prometheus.Labels{"route": route.ID}).Inc()
 
-	// Build destination URL
-	// TODO require all to be named?
-	// destinationURL := route.CompiledSourceURL.ReplaceAllString(sourceURL, route.DestinationURL)
-	// TODO for url and composite
-	// TODO for each non-nil pattern
-	varMatches := make(map[string]string)
-	varCaptures := route.CompiledSourceURL.FindStringSubmatch(sourceURL)
-	varCaptureNames := route.CompiledSourceURL.SubexpNames()
-	for i := range varCaptures {
-		if i > 0 {
-			if varCaptureNames[i] != "" {
-				varMatches[varCaptureNames[i]] = varCaptures[i]
-			}
-		}
-	}
+	// Build destination URL by substituting the named captures collected above
 
-	// TODO
-	varOldNewPairs := make([]string, 0)
+	varOldNewPairs := make([]string, 0, len(varMatches)*2)
 	for key, value := range varMatches {
-		varRepr := fmt.Sprintf("${%v}", key)
-		varOldNewPairs = append(varOldNewPairs, varRepr)
-		varOldNewPairs = append(varOldNewPairs, value)
-		fmt.Printf("REPLACE \"%v\" WITH \"%v\"\n", varRepr, value)
+		varOldNewPairs = append(varOldNewPairs, fmt.Sprintf("${%v}", key), value)
 	}
 	varReplacer := strings.NewReplacer(varOldNewPairs...)
 	destinationURL := varReplacer.Replace(route.DestinationURL)
 
-	// TODO
 	if _, err := url.ParseRequestURI(destinationURL); err != nil {
 		if enableDebug {
 			fmt.Fprintf(os.Stderr, "Malformed destination:\n")
@@ -421,22 +640,25 @@ func handleMainRequest(response http.ResponseWriter, request *http.Request) {
 		}
 		http.Error(response, "400 Malformed destination.\n", http.StatusBadRequest)
 		metricsRouteMalformedDestinationCounter.With(prometheus.Labels{"route": route.ID}).Inc()
-		logRequest(realFrom, 400, route.ID, sourceURL, "")
+		logRequest(request, 400, route.ID, sourceURL, "", time.Since(requestStart))
+		return
+	}
+
+	if route.Mode == "proxy" {
+		handleProxyRequest(response, request, route, destinationURL, sourceURL, realProto, realHost, requestStart)
 		return
 	}
 
 	// Redirect
 	http.Redirect(response, request, destinationURL, route.RedirectStatus)
-	logRequest(realFrom, route.RedirectStatus, route.ID, sourceURL, destinationURL)
+	logRequest(request, route.RedirectStatus, route.ID, sourceURL, destinationURL, time.Since(requestStart))
 }
 
+// findBestRoute finds the highest-priority route matching sourceURL. Callers
+// must hold routesMutex (at least for reading).
 func findBestRoute(sourceURL *string) *Route {
 	var bestRoute *Route
 
-	// Check composite routes
-	// TODO implement
-	// TODO "" means any
-
 	// Check URL routes
 	for _, urlGroup := range urlRoutes {
 		if urlGroup.compiledURL.MatchString(*sourceURL) {
@@ -448,11 +670,644 @@ func findBestRoute(sourceURL *string) *Route {
 		}
 	}
 
+	// Check composite routes
+	scheme, host, port, path, query := splitSourceURL(*sourceURL)
+	for _, schemeGroup := range compositeRoutes {
+		if !matchesPart(schemeGroup.compiledScheme, scheme) {
+			continue
+		}
+		for _, hostGroup := range schemeGroup.hostRoutes {
+			if !matchesPart(hostGroup.compiledHost, host) {
+				continue
+			}
+			for _, portGroup := range hostGroup.portRoutes {
+				if !matchesPart(portGroup.compiledPort, port) {
+					continue
+				}
+				for _, pathGroup := range portGroup.pathRoutes {
+					if !matchesPart(pathGroup.compiledPath, path) {
+						continue
+					}
+					for _, queryGroup := range pathGroup.queryRoutes {
+						if !matchesPart(queryGroup.compiledQuery, query) {
+							continue
+						}
+						for _, route := range queryGroup.routes {
+							if bestRoute == nil || route.Priority > bestRoute.Priority {
+								bestRoute = route
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// Check source template routes
+	for _, templateGroup := range templateRoutes {
+		if _, matched := templateGroup.compiledTemplate.Match(path); matched {
+			for _, route := range templateGroup.routes {
+				if bestRoute == nil || route.Priority > bestRoute.Priority {
+					bestRoute = route
+				}
+			}
+		}
+	}
+
 	return bestRoute
 }
 
-func logRequest(clientAddr string, httpResult int, routeID string, sourceURL string, destinationURL string) {
-	if enableRequestLogging {
-		fmt.Printf("Request: client=\"%v\" status=\"%v\" route=\"%v\" source=\"%v\" destination=\"%v\"\n", clientAddr, httpResult, routeID, sourceURL, destinationURL)
+// matchesPart reports whether the compiled regexp matches value, treating a
+// missing (nil) compiled pattern as matching anything. This is how an unset
+// composite source field ("") behaves, since it's compiled as "" regardless.
+func matchesPart(compiled *regexp.Regexp, value string) bool {
+	if compiled == nil {
+		return true
+	}
+	return compiled.MatchString(value)
+}
+
+// splitSourceURL breaks a built source URL down into the scheme/host/port/
+// path/query pieces matched against the composite route tree.
+func splitSourceURL(sourceURL string) (scheme string, host string, port string, path string, query string) {
+	parsed, err := url.Parse(sourceURL)
+	if err != nil {
+		return
+	}
+	scheme = parsed.Scheme
+	host = parsed.Hostname()
+	port = parsed.Port()
+	path = parsed.Path
+	query = parsed.RawQuery
+	return
+}
+
+// collectVarMatches gathers the named captures produced by whichever source
+// pattern(s) matched the route. A URL route yields captures from the single
+// source URL regex. A composite route yields captures merged from all five
+// composite regexes (scheme, host, port, path, query, in that order), so a
+// capture name declared by more than one field is won by the later field in
+// that order. A source template route yields its path template bindings.
+func collectVarMatches(route *Route, sourceURL string, scheme string, host string, port string, path string, query string) map[string]string {
+	varMatches := make(map[string]string)
+
+	addCaptures := func(compiled *regexp.Regexp, value string) {
+		if compiled == nil {
+			return
+		}
+		captures := compiled.FindStringSubmatch(value)
+		captureNames := compiled.SubexpNames()
+		for i := range captures {
+			if i > 0 && captureNames[i] != "" {
+				varMatches[captureNames[i]] = captures[i]
+			}
+		}
+	}
+
+	switch {
+	case route.CompiledSourceTemplate != nil:
+		if bindings, matched := route.CompiledSourceTemplate.Match(path); matched {
+			for name, value := range bindings {
+				varMatches[name] = value
+			}
+		}
+	case route.CompiledSourceURL != nil:
+		addCaptures(route.CompiledSourceURL, sourceURL)
+	default:
+		addCaptures(route.CompiledSourceScheme, scheme)
+		addCaptures(route.CompiledSourceHost, host)
+		addCaptures(route.CompiledSourcePort, port)
+		addCaptures(route.CompiledSourcePath, path)
+		addCaptures(route.CompiledSourceQuery, query)
+	}
+
+	return varMatches
+}
+
+// logRequest records an access log entry for request if -log is set. duration
+// is measured from the start of request handling, so it's captured even for
+// 404/400 responses that never reach a route's destination.
+func logRequest(request *http.Request, httpResult int, routeID string, sourceURL string, destinationURL string, duration time.Duration) {
+	if !enableRequestLogging || accessLogger == nil {
+		return
+	}
+
+	clientAddr := request.RemoteAddr
+	if forwardedFors := request.Header["X-Forwarded-For"]; len(forwardedFors) > 0 {
+		clientAddr = forwardedFors[0]
+	}
+	var host, path, query string
+	if parsedSource, err := url.Parse(sourceURL); err == nil {
+		host = parsedSource.Host
+		path = parsedSource.Path
+		query = parsedSource.RawQuery
+	}
+
+	accessLogger.Log(accesslog.Record{
+		Timestamp:      time.Now(),
+		Client:         clientAddr,
+		XFFChain:       request.Header.Get("X-Forwarded-For"),
+		Method:         request.Method,
+		Host:           host,
+		Path:           path,
+		Query:          query,
+		Status:         httpResult,
+		RouteID:        routeID,
+		SourceURL:      sourceURL,
+		DestinationURL: destinationURL,
+		DurationMS:     duration.Milliseconds(),
+		UserAgent:      request.UserAgent(),
+	})
+}
+
+// requireAdminAuth checks the bearer token on an admin API request, writing
+// an error response and returning false if it's missing or invalid. The
+// token is compared in constant time, since the admin API can rewrite all
+// routing and a timing side-channel would let an attacker recover it
+// byte-by-byte.
+func requireAdminAuth(response http.ResponseWriter, request *http.Request) bool {
+	if adminToken == "" {
+		http.Error(response, "403 Admin API has no token configured.\n", http.StatusForbidden)
+		return false
+	}
+	const prefix = "Bearer "
+	presented := request.Header.Get("Authorization")
+	validPrefix := strings.HasPrefix(presented, prefix)
+	if validPrefix {
+		presented = strings.TrimPrefix(presented, prefix)
+	}
+	if !validPrefix || subtle.ConstantTimeCompare([]byte(presented), []byte(adminToken)) != 1 {
+		http.Error(response, "401 Unauthorized.\n", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// writeJSON encodes payload as the JSON response body with the given status.
+func writeJSON(response http.ResponseWriter, status int, payload interface{}) {
+	response.Header().Set("Content-Type", "application/json")
+	response.WriteHeader(status)
+	if err := json.NewEncoder(response).Encode(payload); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to encode admin API response: %v\n", err)
+	}
+}
+
+func handleAdminRoutesCollection(response http.ResponseWriter, request *http.Request) {
+	if !requireAdminAuth(response, request) {
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		routesMutex.RLock()
+		writeJSON(response, http.StatusOK, routes)
+		routesMutex.RUnlock()
+	case http.MethodPost:
+		adminCreateRoute(response, request)
+	default:
+		http.Error(response, "405 Method not allowed.\n", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleAdminRoutesItem(response http.ResponseWriter, request *http.Request) {
+	if !requireAdminAuth(response, request) {
+		return
 	}
+
+	id := strings.TrimPrefix(request.URL.Path, "/routes/")
+	if id == "" {
+		http.Error(response, "404 Missing route ID.\n", http.StatusNotFound)
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+		adminGetRoute(response, id)
+	case http.MethodPut:
+		adminUpdateRoute(response, request, id)
+	case http.MethodDelete:
+		adminDeleteRoute(response, id)
+	default:
+		http.Error(response, "405 Method not allowed.\n", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleAdminReload(response http.ResponseWriter, request *http.Request) {
+	if !requireAdminAuth(response, request) {
+		return
+	}
+	if request.Method != http.MethodPost {
+		http.Error(response, "405 Method not allowed.\n", http.StatusMethodNotAllowed)
+		return
+	}
+
+	routesMutex.Lock()
+	defer routesMutex.Unlock()
+
+	if err := reloadRoutesLocked(); err != nil {
+		metricsAdminOperationsCounter.With(prometheus.Labels{"operation": "reload", "result": "error"}).Inc()
+		http.Error(response, fmt.Sprintf("500 Failed to reload routes.\n%v\n", err), http.StatusInternalServerError)
+		return
+	}
+
+	metricsAdminOperationsCounter.With(prometheus.Labels{"operation": "reload", "result": "success"}).Inc()
+	response.WriteHeader(http.StatusOK)
+}
+
+func adminGetRoute(response http.ResponseWriter, id string) {
+	routesMutex.RLock()
+	defer routesMutex.RUnlock()
+
+	route := findRouteByIDLocked(id)
+	if route == nil {
+		http.Error(response, "404 Route not found.\n", http.StatusNotFound)
+		return
+	}
+	writeJSON(response, http.StatusOK, route)
+}
+
+func adminCreateRoute(response http.ResponseWriter, request *http.Request) {
+	var route Route
+	if err := json.NewDecoder(request.Body).Decode(&route); err != nil {
+		http.Error(response, fmt.Sprintf("400 Malformed route JSON.\n%v\n", err), http.StatusBadRequest)
+		return
+	}
+
+	routesMutex.Lock()
+	defer routesMutex.Unlock()
+
+	if findRouteByIDLocked(route.ID) != nil {
+		metricsAdminOperationsCounter.With(prometheus.Labels{"operation": "create", "result": "conflict"}).Inc()
+		http.Error(response, "409 A route with that ID already exists.\n", http.StatusConflict)
+		return
+	}
+
+	routes = append(routes, &route)
+	if err := rebuildRouteTreesLocked(); err != nil {
+		routes = routes[:len(routes)-1]
+		metricsAdminOperationsCounter.With(prometheus.Labels{"operation": "create", "result": "error"}).Inc()
+		http.Error(response, fmt.Sprintf("400 Failed to load route.\n%v\n", err), http.StatusBadRequest)
+		return
+	}
+
+	persistRoutesLocked()
+	metricsAdminOperationsCounter.With(prometheus.Labels{"operation": "create", "result": "success"}).Inc()
+	writeJSON(response, http.StatusCreated, &route)
+}
+
+func adminUpdateRoute(response http.ResponseWriter, request *http.Request, id string) {
+	var updated Route
+	if err := json.NewDecoder(request.Body).Decode(&updated); err != nil {
+		http.Error(response, fmt.Sprintf("400 Malformed route JSON.\n%v\n", err), http.StatusBadRequest)
+		return
+	}
+	updated.ID = id
+
+	routesMutex.Lock()
+	defer routesMutex.Unlock()
+
+	index := -1
+	for i, route := range routes {
+		if route.ID == id {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		metricsAdminOperationsCounter.With(prometheus.Labels{"operation": "update", "result": "not_found"}).Inc()
+		http.Error(response, "404 Route not found.\n", http.StatusNotFound)
+		return
+	}
+
+	previous := routes[index]
+	routes[index] = &updated
+	if err := rebuildRouteTreesLocked(); err != nil {
+		routes[index] = previous
+		metricsAdminOperationsCounter.With(prometheus.Labels{"operation": "update", "result": "error"}).Inc()
+		http.Error(response, fmt.Sprintf("400 Failed to load route.\n%v\n", err), http.StatusBadRequest)
+		return
+	}
+
+	persistRoutesLocked()
+	metricsAdminOperationsCounter.With(prometheus.Labels{"operation": "update", "result": "success"}).Inc()
+	writeJSON(response, http.StatusOK, &updated)
+}
+
+func adminDeleteRoute(response http.ResponseWriter, id string) {
+	routesMutex.Lock()
+	defer routesMutex.Unlock()
+
+	index := -1
+	for i, route := range routes {
+		if route.ID == id {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		metricsAdminOperationsCounter.With(prometheus.Labels{"operation": "delete", "result": "not_found"}).Inc()
+		http.Error(response, "404 Route not found.\n", http.StatusNotFound)
+		return
+	}
+
+	routes = append(routes[:index], routes[index+1:]...)
+	if err := rebuildRouteTreesLocked(); err != nil {
+		metricsAdminOperationsCounter.With(prometheus.Labels{"operation": "delete", "result": "error"}).Inc()
+		http.Error(response, fmt.Sprintf("500 Failed to rebuild routes.\n%v\n", err), http.StatusInternalServerError)
+		return
+	}
+
+	persistRoutesLocked()
+	metricsAdminOperationsCounter.With(prometheus.Labels{"operation": "delete", "result": "success"}).Inc()
+	response.WriteHeader(http.StatusNoContent)
+}
+
+// findRouteByIDLocked looks up a route by ID. Callers must hold routesMutex.
+func findRouteByIDLocked(id string) *Route {
+	for _, route := range routes {
+		if route.ID == id {
+			return route
+		}
+	}
+	return nil
+}
+
+// rebuildRouteTreesLocked rebuilds compositeRoutes/urlRoutes/templateRoutes
+// from the current routes slice. Only a route whose raw source string (or,
+// for a composite route, whichever of its five fields changed) doesn't
+// already have a group in the tree being replaced gets its pattern actually
+// recompiled; loadRoute pulls an unchanged one's compiled regex or template
+// straight from previousCompositeRoutes/previousURLRoutes/
+// previousTemplateRoutes instead.
+// Callers must hold routesMutex for writing; on error the previous tree is
+// left in place.
+func rebuildRouteTreesLocked() error {
+	previousCompositeRoutes, previousURLRoutes, previousTemplateRoutes = compositeRoutes, urlRoutes, templateRoutes
+	compositeRoutes = make(map[string]*schemeRouteGroup)
+	urlRoutes = make(map[string]*urlRouteGroup)
+	templateRoutes = make(map[string]*templateRouteGroup)
+
+	var rebuildErr error
+	for _, route := range routes {
+		if route.Disabled {
+			continue
+		}
+		if err := loadRoute(route); err != nil {
+			compositeRoutes, urlRoutes, templateRoutes = previousCompositeRoutes, previousURLRoutes, previousTemplateRoutes
+			rebuildErr = err
+			break
+		}
+	}
+	previousCompositeRoutes, previousURLRoutes, previousTemplateRoutes = nil, nil, nil
+	if rebuildErr != nil {
+		return rebuildErr
+	}
+
+	// A rebuilt route may have a new ProxyTimeout, or may have been removed
+	// or disabled entirely, so any *httputil.ReverseProxy cached under its ID
+	// would be stale or orphaned. Since the rest of this function already
+	// walks every route, just drop the whole cache rather than tracking
+	// which routes' proxies are actually affected.
+	clearProxyCache()
+
+	return nil
+}
+
+// reloadRoutesLocked re-reads the route set from routeStore and atomically
+// swaps in the resulting routes/compositeRoutes/urlRoutes/templateRoutes.
+// Callers must hold routesMutex for writing.
+func reloadRoutesLocked() error {
+	loadedRoutes, err := routeStore.Load()
+	if err != nil {
+		return err
+	}
+
+	previousRoutes := routes
+	routes = fromStoreRoutes(loadedRoutes)
+	if err := rebuildRouteTreesLocked(); err != nil {
+		routes = previousRoutes
+		return err
+	}
+
+	fmt.Printf("Reloaded %v route(s).\n", len(routes))
+	return nil
+}
+
+// watchRouteStore applies every route set routeStore.Watch sends for as
+// long as the process runs, e.g. on a JSON route file edit or a SQLite
+// route store poll detecting a change.
+func watchRouteStore() {
+	for loadedRoutes := range routeStore.Watch(context.Background()) {
+		routesMutex.Lock()
+		previousRoutes := routes
+		routes = fromStoreRoutes(loadedRoutes)
+		if err := rebuildRouteTreesLocked(); err != nil {
+			routes = previousRoutes
+			fmt.Fprintf(os.Stderr, "Failed to apply route store change: %v\n", err)
+		} else {
+			fmt.Printf("Reloaded %v route(s) after a route store change.\n", len(routes))
+		}
+		routesMutex.Unlock()
+	}
+}
+
+// persistRoutesLocked writes the current routes slice back to routeStore if
+// -admin-persist-routes is set. Failures are logged, not returned, since the
+// in-memory route set has already been applied by the time this runs.
+func persistRoutesLocked() {
+	if !adminPersistRoutes {
+		return
+	}
+	if err := routeStore.Save(toStoreRoutes(routes)); err != nil && err != store.ErrSaveNotSupported {
+		fmt.Fprintf(os.Stderr, "Failed to persist routes: %v\n", err)
+	}
+}
+
+// toStoreRoute strips route down to the fields the route store persists.
+func toStoreRoute(route *Route) *store.Route {
+	return &store.Route{
+		ID:             route.ID,
+		Disabled:       route.Disabled,
+		SourceURL:      route.SourceURL,
+		SourceScheme:   route.SourceScheme,
+		SourceHost:     route.SourceHost,
+		SourcePort:     route.SourcePort,
+		SourcePath:     route.SourcePath,
+		SourceQuery:    route.SourceQuery,
+		SourceTemplate: route.SourceTemplate,
+		DestinationURL: route.DestinationURL,
+		Mode:           route.Mode,
+		RedirectStatus: route.RedirectStatus,
+		ProxyTimeout:   route.ProxyTimeout,
+		Priority:       route.Priority,
+	}
+}
+
+func toStoreRoutes(routes []*Route) []*store.Route {
+	storeRoutes := make([]*store.Route, len(routes))
+	for i, route := range routes {
+		storeRoutes[i] = toStoreRoute(route)
+	}
+	return storeRoutes
+}
+
+// fromStoreRoute builds a Route (with its compiled fields left nil, pending
+// loadRoute) from a store.Route.
+func fromStoreRoute(storeRoute *store.Route) *Route {
+	return &Route{
+		ID:             storeRoute.ID,
+		Disabled:       storeRoute.Disabled,
+		SourceURL:      storeRoute.SourceURL,
+		SourceScheme:   storeRoute.SourceScheme,
+		SourceHost:     storeRoute.SourceHost,
+		SourcePort:     storeRoute.SourcePort,
+		SourcePath:     storeRoute.SourcePath,
+		SourceQuery:    storeRoute.SourceQuery,
+		SourceTemplate: storeRoute.SourceTemplate,
+		DestinationURL: storeRoute.DestinationURL,
+		Mode:           storeRoute.Mode,
+		RedirectStatus: storeRoute.RedirectStatus,
+		ProxyTimeout:   storeRoute.ProxyTimeout,
+		Priority:       storeRoute.Priority,
+	}
+}
+
+func fromStoreRoutes(storeRoutes []*store.Route) []*Route {
+	routes := make([]*Route, len(storeRoutes))
+	for i, storeRoute := range storeRoutes {
+		routes[i] = fromStoreRoute(storeRoute)
+	}
+	return routes
+}
+
+// proxyContextKey is the context.Context key a proxy-mode request's resolved
+// destination and forwarded-header values are attached under, so the shared
+// *httputil.ReverseProxy's Rewrite func can see them without recomputing them.
+type proxyContextKey struct{}
+
+type proxyContext struct {
+	destinationURL string
+	realProto      string
+	realHost       string
+}
+
+// statusRecorder wraps a http.ResponseWriter to capture the status code a
+// proxied response was written with, for metrics and access logging.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// handleProxyRequest forwards request upstream to route's resolved
+// destination via a cached *httputil.ReverseProxy, instead of redirecting
+// the client to it.
+func handleProxyRequest(response http.ResponseWriter, request *http.Request, route *Route, destinationURL string, sourceURL string, realProto string, realHost string, requestStart time.Time) {
+	destination, err := url.Parse(destinationURL)
+	if err != nil || destination.Host == "" {
+		metricsProxyUpstreamErrorsCounter.With(prometheus.Labels{"route": route.ID}).Inc()
+		http.Error(response, "502 Bad gateway.\n", http.StatusBadGateway)
+		logRequest(request, http.StatusBadGateway, route.ID, sourceURL, destinationURL, time.Since(requestStart))
+		return
+	}
+
+	proxy := getOrCreateReverseProxy(route, destination.Host)
+
+	ctx := context.WithValue(request.Context(), proxyContextKey{}, &proxyContext{
+		destinationURL: destinationURL,
+		realProto:      realProto,
+		realHost:       realHost,
+	})
+
+	recorder := &statusRecorder{ResponseWriter: response, status: http.StatusOK}
+	proxy.ServeHTTP(recorder, request.WithContext(ctx))
+
+	metricsProxyRequestsCounter.With(prometheus.Labels{"route": route.ID, "code": strconv.Itoa(recorder.status)}).Inc()
+	logRequest(request, recorder.status, route.ID, sourceURL, destinationURL, time.Since(requestStart))
+}
+
+// getOrCreateReverseProxy returns the cached *httputil.ReverseProxy for
+// route's ID and destinationHost, building and caching one if this is the
+// first time that pair has been seen.
+func getOrCreateReverseProxy(route *Route, destinationHost string) *httputil.ReverseProxy {
+	cacheKey := route.ID + "|" + destinationHost
+
+	proxyCacheMutex.Lock()
+	defer proxyCacheMutex.Unlock()
+
+	if proxy, ok := proxyCache[cacheKey]; ok {
+		return proxy
+	}
+	proxy := buildReverseProxy(route)
+	proxyCache[cacheKey] = proxy
+	return proxy
+}
+
+// clearProxyCache drops every cached *httputil.ReverseProxy, so a rebuild
+// triggered by an admin API mutation, a reload or a route store change
+// doesn't leave a stale or orphaned entry behind for a route that was
+// updated, disabled or deleted.
+func clearProxyCache() {
+	proxyCacheMutex.Lock()
+	defer proxyCacheMutex.Unlock()
+	proxyCache = make(map[string]*httputil.ReverseProxy)
+}
+
+// buildReverseProxy builds a *httputil.ReverseProxy for route whose Rewrite
+// func reads the actual per-request destination and forwarded-header values
+// from the request context (see proxyContext), since they vary per request
+// even though the proxy itself is cached. It uses Rewrite rather than
+// Director so ProxyRequest.SetXForwarded can append this hop's direct peer
+// to the inbound X-Forwarded-For chain exactly once; Director would leave
+// ReverseProxy.ServeHTTP to also auto-append the peer address afterwards,
+// double-counting it.
+func buildReverseProxy(route *Route) *httputil.ReverseProxy {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(proxyReq *httputil.ProxyRequest) {
+			proxyCtx, _ := proxyReq.In.Context().Value(proxyContextKey{}).(*proxyContext)
+			if proxyCtx == nil {
+				return
+			}
+			destination, err := url.Parse(proxyCtx.destinationURL)
+			if err != nil {
+				return
+			}
+
+			proxyReq.Out.URL.Scheme = destination.Scheme
+			proxyReq.Out.URL.Host = destination.Host
+			proxyReq.Out.URL.Path = destination.Path
+			proxyReq.Out.URL.RawQuery = destination.RawQuery
+			proxyReq.Out.Host = destination.Host
+
+			// Carry over the inbound X-Forwarded-For chain so SetXForwarded
+			// appends just this hop's direct peer to it, instead of starting
+			// a fresh chain from the peer alone.
+			proxyReq.Out.Header["X-Forwarded-For"] = proxyReq.In.Header["X-Forwarded-For"]
+			proxyReq.SetXForwarded()
+
+			// SetXForwarded derives proto/host from the local connection, but
+			// realProto/realHost already account for a trusted upstream's own
+			// X-Forwarded-Proto/X-Forwarded-Host, so they take precedence.
+			proxyReq.Out.Header.Set("X-Forwarded-Proto", proxyCtx.realProto)
+			proxyReq.Out.Header.Set("X-Forwarded-Host", proxyCtx.realHost)
+		},
+		ErrorHandler: func(response http.ResponseWriter, request *http.Request, err error) {
+			metricsProxyUpstreamErrorsCounter.With(prometheus.Labels{"route": route.ID}).Inc()
+			http.Error(response, "502 Bad gateway.\n", http.StatusBadGateway)
+		},
+	}
+
+	if route.ProxyTimeout > 0 {
+		timeout := time.Duration(route.ProxyTimeout) * time.Second
+		proxy.Transport = &http.Transport{
+			DialContext:           (&net.Dialer{Timeout: timeout}).DialContext,
+			ResponseHeaderTimeout: timeout,
+		}
+	}
+
+	return proxy
 }
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"testing"
+)
+
+// resetRouteState reinitializes the package-level route trees, as main()
+// does on startup, so each test starts from a clean slate.
+func resetRouteState() {
+	routes = nil
+	compositeRoutes = make(map[string]*schemeRouteGroup)
+	urlRoutes = make(map[string]*urlRouteGroup)
+	templateRoutes = make(map[string]*templateRouteGroup)
+	previousCompositeRoutes = nil
+	previousURLRoutes = nil
+	previousTemplateRoutes = nil
+}
+
+// mustLoadRoute loads route and fails the test immediately if it's rejected.
+func mustLoadRoute(t *testing.T, route *Route) {
+	t.Helper()
+	if err := loadRoute(route); err != nil {
+		t.Fatalf("loadRoute(%q) failed: %v", route.ID, err)
+	}
+}
+
+func TestFindBestRouteCompositeTree(t *testing.T) {
+	resetRouteState()
+
+	low := &Route{ID: "low", SourceHost: "^example\\.com$", SourcePath: "^/a$", DestinationURL: "https://low.invalid/", Priority: 1}
+	high := &Route{ID: "high", SourceHost: "^example\\.com$", SourcePath: "^/a$", DestinationURL: "https://high.invalid/", Priority: 5}
+	other := &Route{ID: "other", SourceHost: "^example\\.com$", SourcePath: "^/b$", DestinationURL: "https://other.invalid/", Priority: 9}
+	mustLoadRoute(t, low)
+	mustLoadRoute(t, high)
+	mustLoadRoute(t, other)
+
+	sourceURL := "https://example.com/a"
+	route := findBestRoute(&sourceURL)
+	if route == nil {
+		t.Fatal("expected a route to match, got nil")
+	}
+	if route.ID != "high" {
+		t.Errorf("expected the higher-priority route \"high\" to win, got %q", route.ID)
+	}
+}
+
+func TestFindBestRouteCompositeEmptyFieldsMatchAnything(t *testing.T) {
+	resetRouteState()
+
+	// SourceScheme, SourcePort and SourceQuery are all left unset, so they
+	// should match any scheme/port/query.
+	route := &Route{ID: "any", SourceHost: "^example\\.com$", SourcePath: "^/a$", DestinationURL: "https://any.invalid/"}
+	mustLoadRoute(t, route)
+
+	sourceURL := "https://example.com:8443/a?x=1"
+	matched := findBestRoute(&sourceURL)
+	if matched == nil || matched.ID != "any" {
+		t.Fatalf("expected route \"any\" to match regardless of scheme/port/query, got %v", matched)
+	}
+}
+
+func TestFindBestRouteCompositeNoMatch(t *testing.T) {
+	resetRouteState()
+
+	route := &Route{ID: "only-a", SourceHost: "^example\\.com$", SourcePath: "^/a$", DestinationURL: "https://only-a.invalid/"}
+	mustLoadRoute(t, route)
+
+	sourceURL := "https://example.com/b"
+	if matched := findBestRoute(&sourceURL); matched != nil {
+		t.Errorf("expected no match for a non-matching path, got %q", matched.ID)
+	}
+}
+
+func TestCollectVarMatchesCompositeMergesAllFields(t *testing.T) {
+	resetRouteState()
+
+	route := &Route{
+		ID:             "merge",
+		SourceScheme:   "^(?P<proto>https?)$",
+		SourceHost:     "^(?P<id>[^.]+)\\.example\\.com$",
+		SourcePath:     "^/(?P<slug>[^/]+)$",
+		DestinationURL: "https://dest.invalid/${proto}/${id}/${slug}",
+	}
+	mustLoadRoute(t, route)
+
+	sourceURL := "https://tenant1.example.com/widgets"
+	scheme, host, port, path, query := splitSourceURL(sourceURL)
+	varMatches := collectVarMatches(route, sourceURL, scheme, host, port, path, query)
+
+	want := map[string]string{"proto": "https", "id": "tenant1", "slug": "widgets"}
+	for name, value := range want {
+		if varMatches[name] != value {
+			t.Errorf("varMatches[%q] = %q, want %q", name, varMatches[name], value)
+		}
+	}
+}
+
+// TestCollectVarMatchesCompositePrecedence checks that when more than one
+// composite field declares the same capture name, the later field in
+// scheme/host/port/path/query order wins, per collectVarMatches' doc comment.
+func TestCollectVarMatchesCompositePrecedence(t *testing.T) {
+	resetRouteState()
+
+	route := &Route{
+		ID:             "precedence",
+		SourceHost:     "^(?P<dup>host-value)\\.example\\.com$",
+		SourcePath:     "^/(?P<dup>path-value)$",
+		DestinationURL: "https://dest.invalid/${dup}",
+	}
+	mustLoadRoute(t, route)
+
+	sourceURL := "https://host-value.example.com/path-value"
+	scheme, host, port, path, query := splitSourceURL(sourceURL)
+	varMatches := collectVarMatches(route, sourceURL, scheme, host, port, path, query)
+
+	if varMatches["dup"] != "path-value" {
+		t.Errorf("expected the later field (path) to win a duplicate capture name, got %q", varMatches["dup"])
+	}
+}
+
+// TestRebuildRouteTreesLockedReusesUnchangedPatterns checks that a rebuild
+// pulls an unchanged route field's compiled regex from the previous
+// generation instead of recompiling it, per rebuildRouteTreesLocked's doc
+// comment.
+func TestRebuildRouteTreesLockedReusesUnchangedPatterns(t *testing.T) {
+	resetRouteState()
+
+	routes = []*Route{
+		{ID: "a", SourceHost: "^example\\.com$", SourcePath: "^/a$", DestinationURL: "https://a.invalid/"},
+	}
+	if err := rebuildRouteTreesLocked(); err != nil {
+		t.Fatalf("initial rebuildRouteTreesLocked failed: %v", err)
+	}
+	firstHostPattern := routes[0].CompiledSourceHost
+	firstPathPattern := routes[0].CompiledSourcePath
+
+	// Add a second route sharing the first's host pattern but with a new
+	// path pattern, then rebuild again.
+	routes = append(routes, &Route{ID: "b", SourceHost: "^example\\.com$", SourcePath: "^/b$", DestinationURL: "https://b.invalid/"})
+	if err := rebuildRouteTreesLocked(); err != nil {
+		t.Fatalf("second rebuildRouteTreesLocked failed: %v", err)
+	}
+
+	if routes[0].CompiledSourceHost != firstHostPattern {
+		t.Error("expected the unchanged host pattern to be reused across rebuilds, got a freshly compiled one")
+	}
+	if routes[0].CompiledSourcePath != firstPathPattern {
+		t.Error("expected route \"a\"'s unchanged path pattern to be reused across rebuilds, got a freshly compiled one")
+	}
+}
+
+func TestCollectVarMatchesSourceURL(t *testing.T) {
+	resetRouteState()
+
+	route := &Route{
+		ID:             "url",
+		SourceURL:      "^https://example\\.com/(?P<slug>[^/]+)$",
+		DestinationURL: "https://dest.invalid/${slug}",
+	}
+	mustLoadRoute(t, route)
+
+	sourceURL := "https://example.com/widgets"
+	scheme, host, port, path, query := splitSourceURL(sourceURL)
+	varMatches := collectVarMatches(route, sourceURL, scheme, host, port, path, query)
+
+	if varMatches["slug"] != "widgets" {
+		t.Errorf("varMatches[\"slug\"] = %q, want %q", varMatches["slug"], "widgets")
+	}
+}
@@ -0,0 +1,139 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// JSONFileStore is the original route store backend: a single JSON file
+// holding an array of routes.
+type JSONFileStore struct {
+	path string
+}
+
+// NewJSONFileStore returns a RouteStore backed by the JSON file at path.
+func NewJSONFileStore(path string) *JSONFileStore {
+	return &JSONFileStore{path: path}
+}
+
+// Load reads and parses the route file.
+func (s *JSONFileStore) Load() ([]*Route, error) {
+	file, openErr := os.Open(s.path)
+	if openErr != nil {
+		return nil, fmt.Errorf("Failed to open route file (missing file?): \n%v", openErr)
+	}
+	defer file.Close()
+
+	data, readErr := io.ReadAll(file)
+	if readErr != nil {
+		return nil, fmt.Errorf("Failed to read route file (I/O error?): \n%v", readErr)
+	}
+
+	var routes []*Route
+	if parseErr := json.Unmarshal(data, &routes); parseErr != nil {
+		return nil, fmt.Errorf("Failed to parse routes from file (malformed JSON file?): \n%v", parseErr)
+	}
+
+	return routes, nil
+}
+
+// Save writes routes back to the route file via write-temp-then-rename, so
+// readers (including this store's own Watch) never see a half-written file.
+func (s *JSONFileStore) Save(routes []*Route) error {
+	data, err := json.MarshalIndent(routes, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to marshal routes: \n%v", err)
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(s.path), ".routes-*.json.tmp")
+	if err != nil {
+		return fmt.Errorf("Failed to create temp route file: \n%v", err)
+	}
+	tempPath := tempFile.Name()
+	defer os.Remove(tempPath)
+
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return fmt.Errorf("Failed to write temp route file: \n%v", err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("Failed to close temp route file: \n%v", err)
+	}
+
+	if err := os.Rename(tempPath, s.path); err != nil {
+		return fmt.Errorf("Failed to persist routes to %v: \n%v", s.path, err)
+	}
+
+	return nil
+}
+
+// Watch watches the route file's directory for changes to it (editors
+// rename-then-write rather than write in place, so the directory, not the
+// file, is watched) and sends the freshly loaded route set on every change.
+// Load errors are dropped with a log line rather than sent, so a transient
+// malformed-file edit doesn't blow away the last good route set.
+func (s *JSONFileStore) Watch(ctx context.Context) <-chan []*Route {
+	updates := make(chan []*Route)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to start route file watcher: %v\n", err)
+		close(updates)
+		return updates
+	}
+
+	dir := filepath.Dir(s.path)
+	if err := watcher.Add(dir); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to watch route file directory %v: %v\n", dir, err)
+		watcher.Close()
+		close(updates)
+		return updates
+	}
+
+	name := filepath.Base(s.path)
+
+	go func() {
+		defer watcher.Close()
+		defer close(updates)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Base(event.Name) != name {
+					continue
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				routes, err := s.Load()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to reload route file after change: %v\n", err)
+					continue
+				}
+				select {
+				case updates <- routes:
+				case <-ctx.Done():
+					return
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				fmt.Fprintf(os.Stderr, "Route file watcher error: %v\n", err)
+			}
+		}
+	}()
+
+	return updates
+}
@@ -0,0 +1,62 @@
+package store
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"sort"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// runMigrations applies every embedded migration not already recorded in
+// schema_migrations, in filename order, each in its own transaction.
+func runMigrations(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (name TEXT PRIMARY KEY)`); err != nil {
+		return fmt.Errorf("Failed to create schema_migrations table: \n%v", err)
+	}
+
+	entries, err := migrationsFS.ReadDir("migrations")
+	if err != nil {
+		return fmt.Errorf("Failed to read embedded migrations: \n%v", err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var applied int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM schema_migrations WHERE name = ?`, name).Scan(&applied); err != nil {
+			return fmt.Errorf("Failed to check migration %v: \n%v", name, err)
+		}
+		if applied > 0 {
+			continue
+		}
+
+		statement, err := migrationsFS.ReadFile("migrations/" + name)
+		if err != nil {
+			return fmt.Errorf("Failed to read migration %v: \n%v", name, err)
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("Failed to begin migration transaction for %v: \n%v", name, err)
+		}
+		if _, err := tx.Exec(string(statement)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Failed to apply migration %v: \n%v", name, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (name) VALUES (?)`, name); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Failed to record migration %v: \n%v", name, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("Failed to commit migration %v: \n%v", name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const defaultPollInterval = 5 * time.Second
+
+// SQLiteStore is a RouteStore backed by a SQLite database (schema in
+// migrations/0001_init.sql). Since SQLite has no native change
+// notification, Watch polls the max(updated_at) column on an interval.
+type SQLiteStore struct {
+	db           *sql.DB
+	pollInterval time.Duration
+}
+
+// NewSQLiteStore opens (creating if needed) the SQLite database at dsn and
+// applies any pending migrations.
+func NewSQLiteStore(dsn string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open SQLite route store: \n%v", err)
+	}
+	if err := db.Ping(); err != nil {
+		return nil, fmt.Errorf("Failed to connect to SQLite route store: \n%v", err)
+	}
+	if err := runMigrations(db); err != nil {
+		return nil, err
+	}
+
+	return &SQLiteStore{db: db, pollInterval: defaultPollInterval}, nil
+}
+
+// Load reads the full current route set from the routes table.
+func (s *SQLiteStore) Load() ([]*Route, error) {
+	rows, err := s.db.Query(`
+		SELECT id, disabled, source_url, source_scheme, source_host, source_port,
+		       source_path, source_query, source_template, destination_url, mode,
+		       redirect_status, proxy_timeout, priority
+		FROM routes`)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query routes: \n%v", err)
+	}
+	defer rows.Close()
+
+	var routes []*Route
+	for rows.Next() {
+		var route Route
+		var disabled int
+		if err := rows.Scan(&route.ID, &disabled, &route.SourceURL, &route.SourceScheme,
+			&route.SourceHost, &route.SourcePort, &route.SourcePath, &route.SourceQuery,
+			&route.SourceTemplate, &route.DestinationURL, &route.Mode, &route.RedirectStatus,
+			&route.ProxyTimeout, &route.Priority); err != nil {
+			return nil, fmt.Errorf("Failed to scan route row: \n%v", err)
+		}
+		route.Disabled = disabled != 0
+		routes = append(routes, &route)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read routes: \n%v", err)
+	}
+
+	return routes, nil
+}
+
+// Save replaces the routes table's contents with routes, in a single
+// transaction, and bumps updated_at so Watch's pollers notice the change.
+func (s *SQLiteStore) Save(routes []*Route) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("Failed to begin save transaction: \n%v", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM routes`); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Failed to clear routes table: \n%v", err)
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO routes (
+			id, disabled, source_url, source_scheme, source_host, source_port,
+			source_path, source_query, source_template, destination_url, mode,
+			redirect_status, proxy_timeout, priority, updated_at
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Failed to prepare route insert: \n%v", err)
+	}
+	defer stmt.Close()
+
+	now := time.Now().Unix()
+	for _, route := range routes {
+		disabled := 0
+		if route.Disabled {
+			disabled = 1
+		}
+		if _, err := stmt.Exec(route.ID, disabled, route.SourceURL, route.SourceScheme,
+			route.SourceHost, route.SourcePort, route.SourcePath, route.SourceQuery,
+			route.SourceTemplate, route.DestinationURL, route.Mode, route.RedirectStatus,
+			route.ProxyTimeout, route.Priority, now); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Failed to insert route %v: \n%v", route.ID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Failed to commit save transaction: \n%v", err)
+	}
+	return nil
+}
+
+// Watch polls max(updated_at) every pollInterval and sends the freshly
+// loaded route set whenever it advances.
+func (s *SQLiteStore) Watch(ctx context.Context) <-chan []*Route {
+	updates := make(chan []*Route)
+
+	go func() {
+		defer close(updates)
+
+		// Seed with the current value so the first tick only fires a reload
+		// if updated_at has actually advanced since Watch started, rather
+		// than unconditionally reloading (and discarding any change made in
+		// memory since, e.g. via the admin API) on every startup.
+		var lastSeen int64
+		if err := s.db.QueryRow(`SELECT COALESCE(MAX(updated_at), 0) FROM routes`).Scan(&lastSeen); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read initial route store state: %v\n", err)
+		}
+
+		ticker := time.NewTicker(s.pollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				var current int64
+				if err := s.db.QueryRow(`SELECT COALESCE(MAX(updated_at), 0) FROM routes`).Scan(&current); err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to poll route store for changes: %v\n", err)
+					continue
+				}
+				if current == lastSeen {
+					continue
+				}
+				lastSeen = current
+
+				routes, err := s.Load()
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Failed to reload routes after change: %v\n", err)
+					continue
+				}
+				select {
+				case updates <- routes:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return updates
+}
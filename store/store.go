@@ -0,0 +1,51 @@
+// Package store defines the RouteStore abstraction used to load, watch and
+// (where supported) persist the route set, and ships two implementations: a
+// JSON file (the historical format, now with fsnotify-based change
+// watching) and a SQLite database.
+package store
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrSaveNotSupported is returned by a RouteStore's Save method when that
+// backend is read-only.
+var ErrSaveNotSupported = errors.New("store: save not supported by this backend")
+
+// Route mirrors the on-disk/in-database representation of a route. It
+// carries no compiled patterns; the caller is responsible for compiling and
+// indexing whatever it loads.
+type Route struct {
+	ID             string `json:"id"`
+	Disabled       bool   `json:"disabled"`
+	SourceURL      string `json:"source_url"`
+	SourceScheme   string `json:"source_scheme"`
+	SourceHost     string `json:"source_host"`
+	SourcePort     string `json:"source_port"`
+	SourcePath     string `json:"source_path"`
+	SourceQuery    string `json:"source_query"`
+	SourceTemplate string `json:"source_template"`
+	DestinationURL string `json:"destination_url"`
+	Mode           string `json:"mode"`
+	RedirectStatus int    `json:"redirect_status"`
+	ProxyTimeout   int    `json:"proxy_timeout"`
+	Priority       int    `json:"priority"`
+}
+
+// RouteStore loads the route set from a backend, optionally watches it for
+// changes, and optionally persists changes back.
+type RouteStore interface {
+	// Load reads and returns the full current route set.
+	Load() ([]*Route, error)
+
+	// Watch returns a channel that receives the full route set every time
+	// the backend detects a change. The channel is closed once ctx is
+	// done. Implementations that can't watch for changes may return a
+	// channel that's never sent on.
+	Watch(ctx context.Context) <-chan []*Route
+
+	// Save persists routes back to the backend. Returns
+	// ErrSaveNotSupported if the backend is read-only.
+	Save(routes []*Route) error
+}
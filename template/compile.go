@@ -0,0 +1,154 @@
+package template
+
+import "strings"
+
+// Op identifies an instruction in a compiled Template's match program.
+type Op int
+
+const (
+	// OpLitPush matches the current request segment against Literal and, on
+	// success, pushes it onto the value stack.
+	OpLitPush Op = iota
+	// OpPush pushes the current request segment onto the value stack, or,
+	// if Multi is set (a "**" segment), joins and pushes all remaining
+	// segments as one value.
+	OpPush
+	// OpConcatN pops the top N values off the stack and pushes them back as
+	// a single "/"-joined value. Used for a binding whose own pattern spans
+	// more than one segment, e.g. "{name=shelves/*}".
+	OpConcatN
+	// OpCapture pops the top value off the stack and binds it to Name.
+	OpCapture
+	// OpEnd marks the end of the program. The match only succeeds if the
+	// whole request path has been consumed by the time it's reached.
+	OpEnd
+)
+
+// Instruction is a single opcode plus whichever operand it needs.
+type Instruction struct {
+	Op      Op
+	Literal string // OpLitPush
+	Multi   bool   // OpPush
+	N       int    // OpConcatN
+	Name    string // OpCapture
+}
+
+// Template is a compiled path template, ready to be matched against request
+// paths.
+type Template struct {
+	Program []Instruction
+	Verb    string
+	raw     string
+}
+
+// Compile parses and compiles a path template such as
+// "/v1/{name=shelves/*}/books/*:batchGet" into a Template. The returned
+// error reports the failing byte position within tmpl.
+func Compile(tmpl string) (*Template, error) {
+	segments, verb, err := parseTemplate(tmpl)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{Program: emitProgram(segments), Verb: verb, raw: tmpl}, nil
+}
+
+// String returns the original template source.
+func (t *Template) String() string {
+	return t.raw
+}
+
+func emitProgram(segments []segment) []Instruction {
+	var program []Instruction
+	for _, seg := range segments {
+		program = append(program, emitSegment(seg)...)
+	}
+	return append(program, Instruction{Op: OpEnd})
+}
+
+func emitSegment(seg segment) []Instruction {
+	switch seg.kind {
+	case segmentLiteral:
+		return []Instruction{{Op: OpLitPush, Literal: seg.literal}}
+	case segmentWildcard:
+		return []Instruction{{Op: OpPush}}
+	case segmentDeepWildcard:
+		return []Instruction{{Op: OpPush, Multi: true}}
+	case segmentVariable:
+		var program []Instruction
+		for _, patternSeg := range seg.pattern {
+			program = append(program, emitSegment(patternSeg)...)
+		}
+		if len(seg.pattern) > 1 {
+			program = append(program, Instruction{Op: OpConcatN, N: len(seg.pattern)})
+		}
+		return append(program, Instruction{Op: OpCapture, Name: seg.name})
+	default:
+		return nil
+	}
+}
+
+// Match runs the compiled program against requestPath (a full request path,
+// e.g. "/v1/shelves/123/books/456:get") and returns the named bindings it
+// collected. The returned bool is false if requestPath doesn't match the
+// template, in which case the map is nil.
+func (t *Template) Match(requestPath string) (map[string]string, bool) {
+	body, verb := splitVerb(requestPath)
+	if verb != t.Verb {
+		return nil, false
+	}
+
+	requestSegments := splitPath(body)
+	captures := make(map[string]string)
+	var stack []string
+	cursor := 0
+
+	for _, instr := range t.Program {
+		switch instr.Op {
+		case OpLitPush:
+			if cursor >= len(requestSegments) || requestSegments[cursor] != instr.Literal {
+				return nil, false
+			}
+			stack = append(stack, requestSegments[cursor])
+			cursor++
+		case OpPush:
+			if instr.Multi {
+				stack = append(stack, strings.Join(requestSegments[cursor:], "/"))
+				cursor = len(requestSegments)
+				continue
+			}
+			if cursor >= len(requestSegments) {
+				return nil, false
+			}
+			stack = append(stack, requestSegments[cursor])
+			cursor++
+		case OpConcatN:
+			if instr.N > len(stack) {
+				return nil, false
+			}
+			start := len(stack) - instr.N
+			joined := strings.Join(stack[start:], "/")
+			stack = append(stack[:start], joined)
+		case OpCapture:
+			if len(stack) == 0 {
+				return nil, false
+			}
+			value := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			captures[instr.Name] = value
+		case OpEnd:
+			if cursor != len(requestSegments) {
+				return nil, false
+			}
+		}
+	}
+
+	return captures, true
+}
+
+func splitPath(path string) []string {
+	trimmed := strings.Trim(path, "/")
+	if trimmed == "" {
+		return nil
+	}
+	return strings.Split(trimmed, "/")
+}
@@ -0,0 +1,231 @@
+// Package template implements the gRPC-transcoding-style path template
+// syntax used by SourceTemplate routes: literal segments, single-segment
+// wildcards ("*"), a trailing multi-segment wildcard ("**"), named bindings
+// ("{name}", "{name=segment/*}", "{name=**}") and an optional ":verb" suffix.
+//
+// It follows the same two-stage shape as go-micro's api/router/util
+// (parse.go turns the template string into a segment tree; compile.go turns
+// the tree into an opcode program that's executed against a split request
+// path).
+package template
+
+import (
+	"fmt"
+	"strings"
+)
+
+type segmentKind int
+
+const (
+	segmentLiteral segmentKind = iota
+	segmentWildcard
+	segmentDeepWildcard
+	segmentVariable
+)
+
+// segment is one parsed piece of a path template, before opcode compilation.
+type segment struct {
+	kind    segmentKind
+	literal string    // set for segmentLiteral
+	name    string    // set for segmentVariable
+	pattern []segment // set for segmentVariable; a bare "{name}" is []segment{{kind: segmentWildcard}}
+	pos     int       // the segment's (or, for a variable, its "{"'s) position within the template, for error reporting
+}
+
+// parseTemplate parses a path template such as
+// "/v1/{name=shelves/*}/books/*:batchGet" into its segments and optional
+// trailing verb.
+func parseTemplate(tmpl string) ([]segment, string, error) {
+	if !strings.HasPrefix(tmpl, "/") {
+		return nil, "", fmt.Errorf("template must start with \"/\"")
+	}
+
+	body, verb := splitVerb(tmpl[1:])
+
+	tokens, err := tokenizeSegments(body, 1)
+	if err != nil {
+		return nil, "", err
+	}
+	segments, err := parseSegments(tokens, 1)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := validateDeepWildcards(segments); err != nil {
+		return nil, "", err
+	}
+	if err := validateUniqueBindings(segments, make(map[string]bool)); err != nil {
+		return nil, "", err
+	}
+
+	return segments, verb, nil
+}
+
+// splitVerb splits a trailing ":verb" off the last path segment of body, or
+// of a request path. A colon inside a "{...}" binding isn't a verb
+// separator.
+func splitVerb(body string) (string, string) {
+	depth := 0
+	for i := len(body) - 1; i >= 0; i-- {
+		switch body[i] {
+		case '}':
+			depth++
+		case '{':
+			depth--
+		case ':':
+			if depth == 0 {
+				return body[:i], body[i+1:]
+			}
+		case '/':
+			if depth == 0 {
+				return body, ""
+			}
+		}
+	}
+	return body, ""
+}
+
+// tokenizeSegments splits body on "/", keeping a "{...}" binding (which may
+// itself contain "/", e.g. "{name=shelves/*}") together as a single token.
+// basePos is the position of body's first byte within the original template.
+func tokenizeSegments(body string, basePos int) ([]string, error) {
+	var tokens []string
+	depth := 0
+	start := 0
+	openPos := 0
+	for i := 0; i < len(body); i++ {
+		switch body[i] {
+		case '{':
+			if depth == 0 {
+				openPos = basePos + i
+			}
+			depth++
+		case '}':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("unbalanced \"}\" at position %v", basePos+i)
+			}
+		case '/':
+			if depth == 0 {
+				tokens = append(tokens, body[start:i])
+				start = i + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced \"{\" at position %v", openPos)
+	}
+	tokens = append(tokens, body[start:])
+	return tokens, nil
+}
+
+// parseSegments parses a flat list of "/"-split tokens into segment values.
+// basePos is the position of the first token's first byte within the
+// original template, used to report an accurate failing position on error.
+func parseSegments(tokens []string, basePos int) ([]segment, error) {
+	segments := make([]segment, 0, len(tokens))
+	pos := basePos
+	for _, token := range tokens {
+		seg, err := parseSegment(token, pos)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, seg)
+		pos += len(token) + 1
+	}
+	return segments, nil
+}
+
+func parseSegment(token string, pos int) (segment, error) {
+	switch {
+	case token == "*":
+		return segment{kind: segmentWildcard, pos: pos}, nil
+	case token == "**":
+		return segment{kind: segmentDeepWildcard, pos: pos}, nil
+	case token == "":
+		return segment{}, fmt.Errorf("empty path segment at position %v", pos)
+	case strings.HasPrefix(token, "{") && strings.HasSuffix(token, "}"):
+		seg, err := parseVariable(token[1:len(token)-1], pos+1)
+		if err != nil {
+			return segment{}, err
+		}
+		seg.pos = pos
+		return seg, nil
+	default:
+		return segment{kind: segmentLiteral, literal: token, pos: pos}, nil
+	}
+}
+
+func parseVariable(body string, pos int) (segment, error) {
+	name := body
+	var patternTokens []string
+	patternPos := pos
+	if eq := strings.IndexByte(body, '='); eq >= 0 {
+		name = body[:eq]
+		patternPos = pos + eq + 1
+		var err error
+		patternTokens, err = tokenizeSegments(body[eq+1:], patternPos)
+		if err != nil {
+			return segment{}, err
+		}
+	}
+	if name == "" {
+		return segment{}, fmt.Errorf("binding has no name at position %v", pos)
+	}
+
+	pattern := []segment{{kind: segmentWildcard}}
+	if patternTokens != nil {
+		var err error
+		pattern, err = parseSegments(patternTokens, patternPos)
+		if err != nil {
+			return segment{}, err
+		}
+	}
+
+	return segment{kind: segmentVariable, name: name, pattern: pattern}, nil
+}
+
+// validateDeepWildcards rejects "**" anywhere but the last segment of the
+// template, or (recursively) the last segment of a binding's own pattern. A
+// binding whose pattern ends in "**" (e.g. "{name=**}") consumes the rest of
+// the request path, so it's rejected unless the binding itself is also the
+// last segment of whatever segment list it's in.
+func validateDeepWildcards(segments []segment) error {
+	for i, seg := range segments {
+		last := i == len(segments)-1
+		if seg.kind == segmentDeepWildcard && !last {
+			return fmt.Errorf("\"**\" is only allowed as the last segment, at position %v", seg.pos)
+		}
+		if seg.kind == segmentVariable {
+			if err := validateDeepWildcards(seg.pattern); err != nil {
+				return err
+			}
+			if !last && endsInDeepWildcard(seg.pattern) {
+				return fmt.Errorf("a binding whose pattern ends in \"**\" is only allowed as the last segment, at position %v", seg.pos)
+			}
+		}
+	}
+	return nil
+}
+
+// endsInDeepWildcard reports whether pattern's last segment is "**".
+func endsInDeepWildcard(pattern []segment) bool {
+	return len(pattern) > 0 && pattern[len(pattern)-1].kind == segmentDeepWildcard
+}
+
+// validateUniqueBindings rejects a template that declares the same binding
+// name more than once, including across nested binding patterns.
+func validateUniqueBindings(segments []segment, seen map[string]bool) error {
+	for _, seg := range segments {
+		if seg.kind != segmentVariable {
+			continue
+		}
+		if seen[seg.name] {
+			return fmt.Errorf("duplicate binding name %q, at position %v", seg.name, seg.pos)
+		}
+		seen[seg.name] = true
+		if err := validateUniqueBindings(seg.pattern, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}